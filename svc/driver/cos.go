@@ -0,0 +1,95 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"github.com/tencentyun/cos-go-sdk-v5"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//COSDriver 腾讯云COS驱动
+type COSDriver struct {
+	client *cos.Client
+}
+
+//COSConfig 驱动初始化所需的连接信息
+type COSConfig struct {
+	BucketURL string //形如 https://<bucket>-<appid>.cos.<region>.myqcloud.com
+	SecretId  string
+	SecretKey string
+}
+
+//NewCOSDriver 创建COS驱动
+func NewCOSDriver(cfg COSConfig) (*COSDriver, error) {
+	u, err := url.Parse(cfg.BucketURL)
+	if err != nil {
+		return nil, err
+	}
+	client := cos.NewClient(&cos.BaseURL{BucketURL: u}, &http.Client{
+		Transport: &cos.AuthorizationTransport{SecretID: cfg.SecretId, SecretKey: cfg.SecretKey},
+	})
+	return &COSDriver{client: client}, nil
+}
+
+func (d *COSDriver) Put(ctx context.Context, key string, reader io.Reader, _ int64) (string, error) {
+	resp, err := d.client.Object.Put(ctx, key, reader, nil)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("Etag"), nil
+}
+
+func (d *COSDriver) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	opt := &cos.ObjectGetOptions{}
+	if length > 0 {
+		opt.Range = cos.FormatRangeOption(offset, offset+length-1)
+	} else if offset > 0 {
+		opt.Range = fmt.Sprintf("bytes=%d-", offset)
+	}
+	resp, err := d.client.Object.Get(ctx, key, opt)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (d *COSDriver) Stat(ctx context.Context, key string) (Info, error) {
+	resp, err := d.client.Object.Head(ctx, key, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	modTime := int64(0)
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		modTime = t.Unix()
+	}
+	return Info{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (d *COSDriver) Delete(ctx context.Context, key string) error {
+	_, err := d.client.Object.Delete(ctx, key)
+	return err
+}
+
+func (d *COSDriver) PresignGet(ctx context.Context, key string, expires int64) (string, error) {
+	ttl := DefaultPresignTTL
+	if expires > 0 {
+		if remaining := time.Unix(expires, 0).Sub(time.Now()); remaining > 0 {
+			ttl = remaining
+		}
+	}
+	u, err := d.client.Object.GetPresignedURL(ctx, http.MethodGet, key,
+		d.client.GetCredential().SecretID, d.client.GetCredential().SecretKey,
+		ttl, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+//FreeSpace COS按量付费，没有固定容量
+func (d *COSDriver) FreeSpace(_ context.Context) (uint64, bool) {
+	return 0, false
+}
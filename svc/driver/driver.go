@@ -0,0 +1,37 @@
+//Package driver 定义存储后端的统一抽象，屏蔽本地磁盘与对象存储的差异
+package driver
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+//DefaultPresignTTL PresignGet的expires<=0表示"不指定时效"，此时对象存储驱动按该值生成一个长期有效的直链
+//（对象存储类后端签名URL本身有最大时效限制，这里取S3/OSS/COS都支持的上限）
+const DefaultPresignTTL = 7 * 24 * time.Hour
+
+//Driver 存储驱动接口，QuickUpload/Download/Sync等上层逻辑只依赖该接口
+type Driver interface {
+	//Put 写入key对应的对象，返回后端生成的etag
+	Put(ctx context.Context, key string, reader io.Reader, size int64) (etag string, err error)
+	//Get 读取key对应对象的[offset, offset+length)字节区间，length<=0表示读到结尾
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	//Stat 返回对象是否存在及其大小、修改时间
+	Stat(ctx context.Context, key string) (Info, error)
+	//Delete 删除key对应的对象
+	Delete(ctx context.Context, key string) error
+	//PresignGet 生成访问直链，expires是unix时间戳；对象存储驱动生成有时效性的签名URL，expires<=0时使用DefaultPresignTTL，
+	//LocalDriver忽略expires，返回不带签名、不过期的静态地址
+	PresignGet(ctx context.Context, key string, expires int64) (string, error)
+	//FreeSpace 返回后端剩余可用空间，对象存储类驱动返回ok=false表示"unlimited"
+	FreeSpace(ctx context.Context) (free uint64, ok bool)
+}
+
+//Info 对象元信息
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime int64
+	IsDir   bool
+}
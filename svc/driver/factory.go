@@ -0,0 +1,27 @@
+package driver
+
+import "fmt"
+
+//Config storage.driver配置块，决定启用哪种后端
+type Config struct {
+	Type string //local/s3/oss/cos
+	S3   S3Config
+	OSS  OSSConfig
+	COS  COSConfig
+}
+
+//New 按配置选择并构造驱动
+func New(cfg Config, localBaseDir, httpSchema, host, group string) (Driver, error) {
+	switch cfg.Type {
+	case "", "local":
+		return NewLocalDriver(localBaseDir, httpSchema, host, group), nil
+	case "s3":
+		return NewS3Driver(cfg.S3), nil
+	case "oss":
+		return NewOSSDriver(cfg.OSS)
+	case "cos":
+		return NewCOSDriver(cfg.COS)
+	default:
+		return nil, fmt.Errorf("unknown storage driver type: %s", cfg.Type)
+	}
+}
@@ -0,0 +1,94 @@
+package driver
+
+import (
+	"context"
+	"eggdfs/util"
+	"fmt"
+	"github.com/shirou/gopsutil/v3/disk"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//LocalDriver 本地磁盘驱动，行为与重构前的os.*/filepath调用保持一致
+type LocalDriver struct {
+	BaseDir    string
+	HttpSchema string
+	Host       string
+	Group      string
+}
+
+//NewLocalDriver 创建本地磁盘驱动
+func NewLocalDriver(baseDir, httpSchema, host, group string) *LocalDriver {
+	return &LocalDriver{BaseDir: baseDir, HttpSchema: httpSchema, Host: host, Group: group}
+}
+
+func (d *LocalDriver) fullPath(key string) string {
+	return filepath.Join(d.BaseDir, key)
+}
+
+func (d *LocalDriver) Put(_ context.Context, key string, reader io.Reader, _ int64) (string, error) {
+	dst := d.fullPath(key)
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return "", err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, reader); err != nil {
+		return "", err
+	}
+	local, err := os.Open(dst)
+	if err != nil {
+		return "", err
+	}
+	defer local.Close()
+	etag, _ := util.GenMD5(local)
+	return etag, nil
+}
+
+func (d *LocalDriver) Get(_ context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(d.fullPath(key))
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if length <= 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (d *LocalDriver) Stat(_ context.Context, key string) (Info, error) {
+	stat, err := os.Stat(d.fullPath(key))
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Key: key, Size: stat.Size(), ModTime: stat.ModTime().Unix(), IsDir: stat.IsDir()}, nil
+}
+
+func (d *LocalDriver) Delete(_ context.Context, key string) error {
+	return os.Remove(d.fullPath(key))
+}
+
+func (d *LocalDriver) PresignGet(_ context.Context, key string, _ int64) (string, error) {
+	return fmt.Sprintf("%s://%s/%s/%s", d.HttpSchema, d.Host, d.Group, key), nil
+}
+
+func (d *LocalDriver) FreeSpace(_ context.Context) (uint64, bool) {
+	stat, err := disk.Usage(d.BaseDir)
+	if err != nil {
+		return 0, true
+	}
+	return stat.Free, true
+}
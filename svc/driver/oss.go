@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//OSSDriver 阿里云OSS驱动
+type OSSDriver struct {
+	bucket *oss.Bucket
+}
+
+//OSSConfig 驱动初始化所需的连接信息
+type OSSConfig struct {
+	Endpoint        string
+	Bucket          string
+	AccessKeyId     string
+	AccessKeySecret string
+}
+
+//NewOSSDriver 创建OSS驱动
+func NewOSSDriver(cfg OSSConfig) (*OSSDriver, error) {
+	client, err := oss.New(cfg.Endpoint, cfg.AccessKeyId, cfg.AccessKeySecret)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := client.Bucket(cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return &OSSDriver{bucket: bucket}, nil
+}
+
+func (d *OSSDriver) Put(_ context.Context, key string, reader io.Reader, _ int64) (string, error) {
+	if err := d.bucket.PutObject(key, reader); err != nil {
+		return "", err
+	}
+	meta, err := d.bucket.GetObjectDetailedMeta(key)
+	if err != nil {
+		return "", nil
+	}
+	return meta.Get("Etag"), nil
+}
+
+func (d *OSSDriver) Get(_ context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	if length > 0 {
+		return d.bucket.GetObject(key, oss.Range(offset, offset+length-1))
+	}
+	if offset > 0 {
+		return d.bucket.GetObject(key, oss.NormalizedRange(fmt.Sprintf("%d-", offset)))
+	}
+	return d.bucket.GetObject(key)
+}
+
+func (d *OSSDriver) Stat(_ context.Context, key string) (Info, error) {
+	meta, err := d.bucket.GetObjectDetailedMeta(key)
+	if err != nil {
+		return Info{}, err
+	}
+	size, _ := strconv.ParseInt(meta.Get("Content-Length"), 10, 64)
+	modTime := int64(0)
+	if t, err := http.ParseTime(meta.Get("Last-Modified")); err == nil {
+		modTime = t.Unix()
+	}
+	return Info{Key: key, Size: size, ModTime: modTime}, nil
+}
+
+func (d *OSSDriver) Delete(_ context.Context, key string) error {
+	return d.bucket.DeleteObject(key)
+}
+
+func (d *OSSDriver) PresignGet(_ context.Context, key string, expires int64) (string, error) {
+	ttlSeconds := int64(DefaultPresignTTL.Seconds())
+	if expires > 0 {
+		if remaining := expires - time.Now().Unix(); remaining > 0 {
+			ttlSeconds = remaining
+		}
+	}
+	return d.bucket.SignURL(key, oss.HTTPGet, ttlSeconds)
+}
+
+//FreeSpace OSS按量付费，没有固定容量
+func (d *OSSDriver) FreeSpace(_ context.Context) (uint64, bool) {
+	return 0, false
+}
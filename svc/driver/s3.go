@@ -0,0 +1,113 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"time"
+)
+
+//S3Driver 兼容S3协议的对象存储驱动(AWS S3/MinIO等)
+type S3Driver struct {
+	client *s3.Client
+	bucket string
+}
+
+//S3Config 驱动初始化所需的连接信息，来自storage.driver配置块
+type S3Config struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyId     string
+	SecretAccessKey string
+	UsePathStyle    bool //MinIO等私有化部署通常需要开启
+}
+
+//NewS3Driver 创建S3驱动
+func NewS3Driver(cfg S3Config) *S3Driver {
+	resolver := aws.EndpointResolverWithOptionsFunc(func(_, _ string, _ ...interface{}) (aws.Endpoint, error) {
+		if cfg.Endpoint == "" {
+			return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+		}
+		return aws.Endpoint{URL: cfg.Endpoint, SigningRegion: cfg.Region}, nil
+	})
+	client := s3.New(s3.Options{
+		Region:                          cfg.Region,
+		Credentials:                     credentials.NewStaticCredentialsProvider(cfg.AccessKeyId, cfg.SecretAccessKey, ""),
+		EndpointResolverWithOptionsFunc: resolver,
+		UsePathStyle:                    cfg.UsePathStyle,
+	})
+	return &S3Driver{client: client, bucket: cfg.Bucket}
+}
+
+func (d *S3Driver) Put(ctx context.Context, key string, reader io.Reader, size int64) (string, error) {
+	uploader := manager.NewUploader(d.client)
+	out, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(d.bucket),
+		Key:           aws.String(key),
+		Body:          reader,
+		ContentLength: size,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+func (d *S3Driver) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{Bucket: aws.String(d.bucket), Key: aws.String(key)}
+	if length > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	out, err := d.client.GetObject(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (d *S3Driver) Stat(ctx context.Context, key string) (Info, error) {
+	out, err := d.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(d.bucket), Key: aws.String(key)})
+	if err != nil {
+		return Info{}, err
+	}
+	modTime := int64(0)
+	if out.LastModified != nil {
+		modTime = out.LastModified.Unix()
+	}
+	return Info{Key: key, Size: out.ContentLength, ModTime: modTime}, nil
+}
+
+func (d *S3Driver) Delete(ctx context.Context, key string) error {
+	_, err := d.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(d.bucket), Key: aws.String(key)})
+	return err
+}
+
+func (d *S3Driver) PresignGet(ctx context.Context, key string, expires int64) (string, error) {
+	ttl := DefaultPresignTTL
+	if expires > 0 {
+		if remaining := time.Unix(expires, 0).Sub(time.Now()); remaining > 0 {
+			ttl = remaining
+		}
+	}
+	presignClient := s3.NewPresignClient(d.client)
+	req, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+//FreeSpace 对象存储没有固定容量上限，交由上层展示为"unlimited"
+func (d *S3Driver) FreeSpace(_ context.Context) (uint64, bool) {
+	return 0, false
+}
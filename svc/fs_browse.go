@@ -0,0 +1,462 @@
+package svc
+
+import (
+	"context"
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/h2non/filetype"
+	"go.uber.org/zap"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	thumbDirName      = ".thumbs"
+	thumbMaxEdge      = 256
+	listCacheTTL      = 5 * time.Second
+	defaultPageSize   = 50
+)
+
+//DirEntry 目录浏览返回的单条记录
+type DirEntry struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	IsDir    bool   `json:"is_dir"`
+	Modified int64  `json:"modified"`
+	Md5      string `json:"md5"`
+	Url      string `json:"url"`
+	Mime     string `json:"mime"`
+	Thumb    string `json:"thumb"`
+}
+
+//ListResult GET /v1/fs/list 的响应体
+type ListResult struct {
+	Content []DirEntry `json:"content"`
+	Total   int        `json:"total"`
+	Readme  string     `json:"readme"`
+}
+
+type listCacheEntry struct {
+	result  ListResult
+	cachedAt time.Time
+}
+
+var (
+	listCache   = map[string]listCacheEntry{}
+	listCacheMu sync.Mutex
+)
+
+//safeJoin 将用户传入的相对路径拼接到base(StorageDir)下，并校验结果没有借助".."越出base，用于修复目录遍历
+func safeJoin(base string, elem ...string) (string, error) {
+	full := filepath.Join(append([]string{base}, elem...)...)
+	rel, err := filepath.Rel(base, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("非法路径")
+	}
+	return full, nil
+}
+
+//requireLocalDriver 目录浏览/归档/转码等任务直接用os.*读写StorageDir，无法感知s3/oss/cos等对象存储后端，
+//在non-local驱动下显式拒绝，而不是让调用方拿到一堆难以理解的底层IO报错
+func requireLocalDriver() error {
+	if t := config().Storage.Driver.Type; t != "" && t != "local" {
+		return fmt.Errorf("该功能仅支持local存储驱动，当前驱动为%s", t)
+	}
+	return nil
+}
+
+//List GET /v1/fs/list 分页、排序浏览目录
+func (s *Storage) List(c *gin.Context) {
+	if err := requireLocalDriver(); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	dirPath := c.DefaultQuery("path", "")
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+	orderBy := c.DefaultQuery("order_by", "name")
+	order := c.DefaultQuery("order", "asc")
+	refresh := c.Query("refresh") == "true"
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+
+	cacheKey := dirPath + "|" + orderBy + "|" + order
+	if !refresh {
+		listCacheMu.Lock()
+		entry, ok := listCache[cacheKey]
+		listCacheMu.Unlock()
+		if ok && time.Since(entry.cachedAt) < listCacheTTL {
+			c.JSON(http.StatusOK, model.RespResult{Status: common.Success, Data: paginate(entry.result, page, pageSize)})
+			return
+		}
+	}
+
+	full, err := safeJoin(config().Storage.StorageDir, dirPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	items, err := os.ReadDir(full)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "目录不存在"})
+		return
+	}
+
+	entries := make([]DirEntry, 0, len(items))
+	readme := ""
+	for _, item := range items {
+		if strings.HasPrefix(item.Name(), ".") {
+			continue //跳过.uploads/.thumbs/.shards等内部目录
+		}
+		info, err := item.Info()
+		if err != nil {
+			continue
+		}
+		entry := DirEntry{
+			Name:     item.Name(),
+			Size:     info.Size(),
+			IsDir:    item.IsDir(),
+			Modified: info.ModTime().Unix(),
+		}
+		relPath := filepath.Join(dirPath, item.Name())
+		if !item.IsDir() {
+			entry.Url = s.GenFileStaticUrl(dirPath, item.Name())
+			data, _ := os.ReadFile(filepath.Join(full, item.Name()))
+			if kind, err := filetype.Match(data); err == nil && kind != filetype.Unknown {
+				entry.Mime = kind.MIME.Value
+			}
+			if local, err := os.Open(filepath.Join(full, item.Name())); err == nil {
+				entry.Md5, _ = util.GenMD5(local)
+				local.Close()
+			}
+			if entry.Mime != "" && (strings.HasPrefix(entry.Mime, "image/") || strings.HasPrefix(entry.Mime, "video/")) {
+				entry.Thumb = fmt.Sprintf("%s://%s/v1/fs/thumb?md5=%s",
+					s.httpSchema, config().Host+":"+config().Port, entry.Md5)
+			}
+			if strings.EqualFold(item.Name(), "readme.md") {
+				readme = relPath
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	sortEntries(entries, orderBy, order)
+
+	result := ListResult{Content: entries, Total: len(entries), Readme: readme}
+	listCacheMu.Lock()
+	listCache[cacheKey] = listCacheEntry{result: result, cachedAt: time.Now()}
+	listCacheMu.Unlock()
+
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success, Data: paginate(result, page, pageSize)})
+}
+
+func sortEntries(entries []DirEntry, orderBy, order string) {
+	less := func(i, j int) bool {
+		switch orderBy {
+		case "size":
+			return entries[i].Size < entries[j].Size
+		case "modified":
+			return entries[i].Modified < entries[j].Modified
+		default:
+			return entries[i].Name < entries[j].Name
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if order == "desc" {
+			return !less(i, j)
+		}
+		return less(i, j)
+	})
+}
+
+func paginate(result ListResult, page, pageSize int) ListResult {
+	start := (page - 1) * pageSize
+	if start > len(result.Content) {
+		start = len(result.Content)
+	}
+	end := start + pageSize
+	if end > len(result.Content) {
+		end = len(result.Content)
+	}
+	return ListResult{Content: result.Content[start:end], Total: result.Total, Readme: result.Readme}
+}
+
+//Thumb GET /v1/fs/thumb?md5=... 生成并缓存图片/视频(第1秒处的一帧)缩略图
+func (s *Storage) Thumb(c *gin.Context) {
+	if err := requireLocalDriver(); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	md5hash := c.Query("md5")
+	if md5hash == "" {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
+		return
+	}
+	thumbPath := fmt.Sprintf("%s/%s/%s.jpg", config().Storage.StorageDir, thumbDirName, md5hash)
+	if _, err := os.Stat(thumbPath); err == nil {
+		c.File(thumbPath)
+		return
+	}
+
+	data, err := s.db.Get(md5hash)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "文件不存在"})
+		return
+	}
+	fi := model.FileInfo{}
+	if err := json.Unmarshal(data, &fi); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail})
+		return
+	}
+
+	srcPath := config().Storage.StorageDir + "/" + fi.Path
+	var img image.Image
+	if kind, kErr := filetype.MatchFile(srcPath); kErr == nil && kind != filetype.Unknown && strings.HasPrefix(kind.MIME.Value, "video/") {
+		img, err = extractVideoFrame(c.Request.Context(), srcPath)
+	} else {
+		img, _, err = decodeImage(srcPath)
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "暂不支持该类型的缩略图"})
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(thumbPath), os.ModePerm); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.DirCreateFail})
+		return
+	}
+	out, err := os.Create(thumbPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.FileSaveFail})
+		return
+	}
+	defer out.Close()
+	if err := jpeg.Encode(out, util.ResizeToEdge(img, thumbMaxEdge), &jpeg.Options{Quality: 80}); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail})
+		return
+	}
+	c.File(thumbPath)
+}
+
+func decodeImage(path string) (image.Image, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	return image.Decode(f)
+}
+
+//extractVideoFrame 借助ffmpeg截取视频第1秒的一帧作为缩略图源图，复用runTranscode同款ffmpeg调用方式
+func extractVideoFrame(ctx context.Context, srcPath string) (image.Image, error) {
+	tmp, err := os.CreateTemp("", "thumb-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-ss", "00:00:01", "-i", srcPath, "-frames:v", "1", "-f", "image2", tmpPath)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg截帧失败: %w", err)
+	}
+	img, _, err := decodeImage(tmpPath)
+	return img, err
+}
+
+//Mkdir POST /v1/fs/mkdir 创建目录并同步给其它节点
+func (s *Storage) Mkdir(c *gin.Context) {
+	if err := requireLocalDriver(); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	dirPath := c.PostForm("path")
+	if dirPath == "" {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
+		return
+	}
+	full, err := safeJoin(config().Storage.StorageDir, dirPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	if err := os.MkdirAll(full, os.ModePerm); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.DirCreateFail})
+		return
+	}
+	s.broadcastNamespaceChange(common.SyncMkdir, model.SyncFileInfo{FilePath: dirPath, Group: config().Storage.Group})
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+}
+
+//Rename POST /v1/fs/rename 重命名文件/目录并同步给其它节点
+func (s *Storage) Rename(c *gin.Context) {
+	if err := requireLocalDriver(); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	dirPath := c.PostForm("path")
+	oldName := c.PostForm("old_name")
+	newName := c.PostForm("new_name")
+	if dirPath == "" || oldName == "" || newName == "" {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
+		return
+	}
+	base, err := safeJoin(config().Storage.StorageDir, dirPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	oldFull, err := safeJoin(base, oldName)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	newFull, err := safeJoin(base, newName)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	if err := os.Rename(oldFull, newFull); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	s.broadcastNamespaceChange(common.SyncRename, model.SyncFileInfo{
+		FilePath: dirPath, FileName: oldName, NewName: newName, Group: config().Storage.Group,
+	})
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+}
+
+//Move POST /v1/fs/move 移动文件/目录到新路径并同步给其它节点
+func (s *Storage) Move(c *gin.Context) {
+	if err := requireLocalDriver(); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	srcPath := c.PostForm("path")
+	name := c.PostForm("name")
+	dstPath := c.PostForm("dst_path")
+	if srcPath == "" || name == "" || dstPath == "" {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
+		return
+	}
+	dst, err := safeJoin(config().Storage.StorageDir, dstPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.DirCreateFail})
+		return
+	}
+	src, err := safeJoin(config().Storage.StorageDir, srcPath, name)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	dstFull, err := safeJoin(dst, name)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	if err := os.Rename(src, dstFull); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	s.broadcastNamespaceChange(common.SyncMove, model.SyncFileInfo{
+		FilePath: srcPath, FileName: name, NewPath: dstPath, Group: config().Storage.Group,
+	})
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+}
+
+//Rm DELETE /v1/fs/rm 删除文件/目录并同步给其它节点
+func (s *Storage) Rm(c *gin.Context) {
+	if err := requireLocalDriver(); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	dirPath := c.Query("path")
+	name := c.Query("name")
+	if dirPath == "" || name == "" {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
+		return
+	}
+	full, err := safeJoin(config().Storage.StorageDir, dirPath, name)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	if err := os.RemoveAll(full); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	s.broadcastNamespaceChange(common.SyncDelete, model.SyncFileInfo{
+		FilePath: dirPath, FileName: name, Group: config().Storage.Group,
+	})
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+}
+
+//SyncMkdir 接收对等节点广播的mkdir事件，在本地创建对应目录
+func (s *Storage) SyncMkdir(sync model.SyncFileInfo, c *gin.Context) {
+	full := filepath.Join(config().Storage.StorageDir, sync.FilePath)
+	if err := os.MkdirAll(full, os.ModePerm); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.DirCreateFail})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+}
+
+//SyncRename 接收对等节点广播的rename事件，在本地同步重命名
+func (s *Storage) SyncRename(sync model.SyncFileInfo, c *gin.Context) {
+	base := filepath.Join(config().Storage.StorageDir, sync.FilePath)
+	if err := os.Rename(filepath.Join(base, sync.FileName), filepath.Join(base, sync.NewName)); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+}
+
+//SyncMove 接收对等节点广播的move事件，在本地同步移动
+func (s *Storage) SyncMove(sync model.SyncFileInfo, c *gin.Context) {
+	dst := filepath.Join(config().Storage.StorageDir, sync.NewPath)
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.DirCreateFail})
+		return
+	}
+	src := filepath.Join(config().Storage.StorageDir, sync.FilePath, sync.FileName)
+	if err := os.Rename(src, filepath.Join(dst, sync.FileName)); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+}
+
+//broadcastNamespaceChange 把目录树变更(mkdir/rename/move/delete)以SyncFileInfo事件广播给同组的对等节点
+func (s *Storage) broadcastNamespaceChange(action int, sync model.SyncFileInfo) {
+	sync.Action = action
+	for _, peer := range config().Storage.Peers {
+		go func(peer string) {
+			if _, err := util.HttpPost(peer+"/sync", sync, nil, time.Second*5); err != nil {
+				logger.Warn("命名空间变更同步失败", zap.String("peer", peer), zap.Int("action", action))
+			}
+		}(peer)
+	}
+}
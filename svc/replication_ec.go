@@ -0,0 +1,317 @@
+package svc
+
+import (
+	"bytes"
+	"context"
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/reedsolomon"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+)
+
+const shardManifestKeyPref = "manifest:"
+
+//ShardManifest 纠删码分片清单，描述一个文件被拆分到哪些节点的哪些分片
+type ShardManifest struct {
+	FileId      string   `json:"file_id"`
+	K           int      `json:"k"`
+	M           int      `json:"m"`
+	ShardHosts  []string `json:"shard_hosts"`
+	ShardMD5    []string `json:"shard_md5"`
+	OriginalMD5 string   `json:"original_md5"`
+	Size        int64    `json:"size"`
+}
+
+func (s *Storage) saveShardManifest(mf *ShardManifest) error {
+	bytes, err := json.Marshal(mf)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(shardManifestKeyPref+mf.FileId, bytes)
+}
+
+func (s *Storage) loadShardManifest(fileId string) (*ShardManifest, error) {
+	data, err := s.db.Get(shardManifestKeyPref + fileId)
+	if err != nil {
+		return nil, err
+	}
+	mf := &ShardManifest{}
+	if err := json.Unmarshal(data, mf); err != nil {
+		return nil, err
+	}
+	return mf, nil
+}
+
+//ReplicateEC 以纠删码方式将已保存的文件拆分为k+m个分片并分发到不同的对等节点
+//fileId/key/peers由调用方在SaveQuickUploadedFile成功后传入，key是传给driver.Put的同一个相对路径，peers长度需等于k+m
+//通过s.driver读取而非直接访问本地磁盘，使EC复制模式对local/s3/oss/cos后端一视同仁
+func (s *Storage) ReplicateEC(fileId, key string, size int64, k, m int, peers []string) error {
+	if len(peers) != k+m {
+		return fmt.Errorf("ec replication needs exactly %d peers, got %d", k+m, len(peers))
+	}
+
+	enc, err := reedsolomon.New(k, m)
+	if err != nil {
+		return err
+	}
+
+	body, err := s.driver.Get(context.Background(), key, 0, 0)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	shards, err := enc.Split(data)
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(shards); err != nil {
+		return err
+	}
+
+	hashes := make([]string, len(shards))
+	for i, shard := range shards {
+		md5hash, _ := util.GenMD5Bytes(shard)
+		hashes[i] = md5hash
+	}
+
+	//原始文件md5写入清单，供Reconstruct校验重建结果
+	originalMD5, _ := util.GenMD5Bytes(data)
+
+	for i, shard := range shards {
+		payload := struct {
+			FileId     string `json:"file_id"`
+			ShardIndex int    `json:"shard_index"`
+			K          int    `json:"k"`
+			M          int    `json:"m"`
+			Md5        string `json:"md5"`
+			TotalSize  int64  `json:"total_size"`
+		}{FileId: fileId, ShardIndex: i, K: k, M: m, Md5: hashes[i], TotalSize: size}
+
+		resp, err := util.HttpPostMultipart(peers[i]+"/v1/shard", payload, "shard", fmt.Sprintf("%s.%d", fileId, i), shard)
+		if err != nil || resp == nil {
+			logger.Warn("分片分发失败", zap.String("peer", peers[i]), zap.Int("shard_index", i))
+			go s.TransErrorLogToTracker(common.FileSaveFail, fmt.Sprintf("分片%d分发到%s失败", i, peers[i]))
+		}
+	}
+
+	mf := &ShardManifest{
+		FileId:      fileId,
+		K:           k,
+		M:           m,
+		ShardHosts:  peers,
+		ShardMD5:    hashes,
+		OriginalMD5: originalMD5,
+		Size:        size,
+	}
+	return s.saveShardManifest(mf)
+}
+
+//ReceiveShard 接收其它节点POST过来的分片，落盘到.shards/<file_id>/<index>
+func (s *Storage) ReceiveShard(c *gin.Context) {
+	fileId := c.PostForm("file_id")
+	indexStr := c.PostForm("shard_index")
+	file, err := c.FormFile("shard")
+	if fileId == "" || err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
+		return
+	}
+	dir, err := safeJoin(config().Storage.StorageDir, ".shards", fileId)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.DirCreateFail})
+		return
+	}
+	shardPath, err := safeJoin(dir, indexStr)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail})
+		return
+	}
+	defer src.Close()
+	out, err := os.Create(shardPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.FileSaveFail})
+		return
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, src); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.FileSaveFail})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+}
+
+//GetShard GET /v1/shard?file_id=...&shard_index=... 将本节点落盘的分片原样返回，供对端Reconstruct/repairShards拉取
+func (s *Storage) GetShard(c *gin.Context) {
+	fileId := c.Query("file_id")
+	indexStr := c.Query("shard_index")
+	if fileId == "" || indexStr == "" {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
+		return
+	}
+	path, err := safeJoin(config().Storage.StorageDir, ".shards", fileId, indexStr)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: err.Error()})
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "分片不存在"})
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail})
+		return
+	}
+	c.Writer.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
+	c.Status(http.StatusOK)
+	_, _ = io.Copy(c.Writer, f)
+}
+
+//Reconstruct GET /v1/reconstruct?file_id=... 拉取任意k个存活分片重建文件并校验md5后流式返回
+func (s *Storage) Reconstruct(c *gin.Context) {
+	fileId := c.Query("file_id")
+	mf, err := s.loadShardManifest(fileId)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "未找到分片清单"})
+		return
+	}
+
+	shards := make([][]byte, mf.K+mf.M)
+	present := 0
+	for i, host := range mf.ShardHosts {
+		data, err := util.HttpGetBytes(fmt.Sprintf("%s/v1/shard?file_id=%s&shard_index=%d", host, fileId, i))
+		if err != nil {
+			continue
+		}
+		shards[i] = data
+		present++
+		if present >= mf.K {
+			break
+		}
+	}
+	if present < mf.K {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "存活分片不足以重建"})
+		return
+	}
+
+	enc, err := reedsolomon.New(mf.K, mf.M)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail})
+		return
+	}
+	if err := enc.Reconstruct(shards); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+
+	w := &bytes.Buffer{}
+	if err := enc.Join(w, shards, int(mf.Size)); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	md5hash, _ := util.GenMD5Bytes(w.Bytes())
+	if md5hash != mf.OriginalMD5 {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "重建文件校验失败"})
+		return
+	}
+
+	c.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileId))
+	c.Data(http.StatusOK, "application/octet-stream", w.Bytes())
+}
+
+//repairShards 周期性检查每个分片是否存活，使用幸存分片重新编码缺失的分片
+func (s *Storage) repairShards() {
+	keys, err := s.db.Keys(shardManifestKeyPref)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		data, err := s.db.Get(key)
+		if err != nil {
+			continue
+		}
+		mf := &ShardManifest{}
+		if err := json.Unmarshal(data, mf); err != nil {
+			continue
+		}
+
+		missing := make([]int, 0)
+		for i, host := range mf.ShardHosts {
+			if _, err := util.HttpHead(fmt.Sprintf("%s/v1/shard?file_id=%s&shard_index=%d", host, mf.FileId, i)); err != nil {
+				missing = append(missing, i)
+			}
+		}
+		if len(missing) == 0 || len(mf.ShardHosts)-len(missing) < mf.K {
+			continue //要么健康，要么存活分片都不够重建，跳过
+		}
+		logger.Info("修复纠删码分片", zap.String("file_id", mf.FileId), zap.Ints("missing", missing))
+		s.repairOneManifest(mf, missing)
+	}
+}
+
+func (s *Storage) repairOneManifest(mf *ShardManifest, missing []int) {
+	shards := make([][]byte, mf.K+mf.M)
+	present := 0
+	for i, host := range mf.ShardHosts {
+		isMissing := false
+		for _, m := range missing {
+			if m == i {
+				isMissing = true
+				break
+			}
+		}
+		if isMissing {
+			continue
+		}
+		data, err := util.HttpGetBytes(fmt.Sprintf("%s/v1/shard?file_id=%s&shard_index=%d", host, mf.FileId, i))
+		if err != nil {
+			continue
+		}
+		shards[i] = data
+		present++
+	}
+	if present < mf.K {
+		logger.Warn("修复失败：存活分片不足", zap.String("file_id", mf.FileId))
+		return
+	}
+	enc, err := reedsolomon.New(mf.K, mf.M)
+	if err != nil {
+		return
+	}
+	if err := enc.Reconstruct(shards); err != nil {
+		logger.Warn("修复失败：重建出错", zap.String("file_id", mf.FileId), zap.Error(err))
+		return
+	}
+	for _, idx := range missing {
+		payload := struct {
+			FileId     string `json:"file_id"`
+			ShardIndex int    `json:"shard_index"`
+			K          int    `json:"k"`
+			M          int    `json:"m"`
+		}{FileId: mf.FileId, ShardIndex: idx, K: mf.K, M: mf.M}
+		_, _ = util.HttpPostMultipart(mf.ShardHosts[idx]+"/v1/shard", payload, "shard",
+			fmt.Sprintf("%s.%d", mf.FileId, idx), shards[idx])
+	}
+}
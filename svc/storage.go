@@ -1,19 +1,20 @@
 package svc
 
 import (
+	"context"
 	"eggdfs/common"
 	"eggdfs/common/model"
 	"eggdfs/logger"
 	"eggdfs/svc/conf"
+	"eggdfs/svc/driver"
+	"eggdfs/svc/task"
 	"eggdfs/util"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/robfig/cron/v3"
-	"github.com/shirou/gopsutil/v3/disk"
 	"go.uber.org/zap"
-	"io"
 	"mime/multipart"
 	"net"
 	"net/http"
@@ -27,12 +28,17 @@ import (
 
 const (
 	storageDBFileName = "storage"
+	//defaultMaxParallelTransfer Storage.MaxParallelTransfer未配置时SyncFileAdd的默认并发下载数
+	defaultMaxParallelTransfer = 4
 )
 
 type Storage struct {
 	db         *model.EggDB
 	httpSchema string
 	trackers   []string
+	driver     driver.Driver
+	tasks      *task.Queue
+	syncSem    chan struct{} //限制SyncFileAdd的并发下载数，由Storage.MaxParallelTransfer配置
 }
 
 type StorageStatus struct {
@@ -44,10 +50,21 @@ type StorageStatus struct {
 }
 
 func NewStorage() *Storage {
+	c := config()
+	d, err := driver.New(c.Storage.Driver, c.Storage.StorageDir, c.HttpSchema, net.JoinHostPort(c.Host, c.Port), c.Storage.Group)
+	if err != nil {
+		logger.Panic("存储驱动初始化失败", zap.Error(err))
+	}
+	maxParallelTransfer := c.Storage.MaxParallelTransfer
+	if maxParallelTransfer <= 0 {
+		maxParallelTransfer = defaultMaxParallelTransfer
+	}
 	return &Storage{
 		db:         model.NewEggDB(storageDBFileName),
-		httpSchema: config().HttpSchema,
-		trackers:   config().Storage.Trackers,
+		httpSchema: c.HttpSchema,
+		trackers:   c.Storage.Trackers,
+		driver:     d,
+		syncSem:    make(chan struct{}, maxParallelTransfer),
 	}
 }
 
@@ -81,22 +98,6 @@ func (s *Storage) QuickUpload(c *gin.Context) {
 
 	customDir := c.GetHeader(common.HeaderUploadFileDir)
 	filePath := util.GenFilePath(customDir)
-	baseDir := config().Storage.StorageDir + "/" + filePath
-	if _, err := os.Stat(baseDir); err != nil {
-		err := os.MkdirAll(baseDir, os.ModePerm)
-		p, _ := filepath.Abs(config().Storage.StorageDir)
-		if err != nil {
-			logger.Error("文件保存路径创建失败", zap.String("file_baseDir", p))
-			go s.TransErrorLogToTracker(common.DirCreateFail, "文件保存路径创建失败"+p)
-			c.JSON(http.StatusOK, model.RespResult{
-				Status:  common.DirCreateFail,
-				Message: "文件保存路径创建失败",
-				Data:    nil,
-			})
-			return
-		}
-		logger.Info("文件保存路径创建成功", zap.String("file_baseDir", p))
-	}
 
 	file, err := c.FormFile("file")
 	if err != nil {
@@ -123,8 +124,8 @@ func (s *Storage) QuickUpload(c *gin.Context) {
 	//文件名由雪花算法的服务器生成
 	uuid := c.GetHeader(common.HeaderFileUUID)
 	fileName := util.GenFileName(uuid, file.Filename)
-	fullPath := baseDir + "/" + fileName
-	md5hash, err := s.SaveQuickUploadedFile(file, fullPath, fileHash)
+	key := filePath + "/" + fileName
+	md5hash, err := s.SaveQuickUploadedFile(file, key, fileHash)
 	if err != nil {
 		c.JSON(http.StatusOK, model.RespResult{
 			Status:  common.FileSaveFail,
@@ -144,6 +145,17 @@ func (s *Storage) QuickUpload(c *gin.Context) {
 	}
 	bytes, _ := json.Marshal(fi)
 	_ = s.db.Put(fi.Md5, bytes)
+
+	//纠删码复制模式下，将文件拆分为k+m个分片分发到对等节点，替代整份全量复制
+	if config().Storage.ReplicationMode == "ec" {
+		ecConf := config().Storage.EC
+		go func() {
+			if err := s.ReplicateEC(uuid, key, fi.Size, ecConf.K, ecConf.M, ecConf.Peers); err != nil {
+				logger.Warn("纠删码分片分发失败", zap.String("file_id", uuid), zap.Error(err))
+			}
+		}()
+	}
+
 	c.Writer.Header().Set(common.HeaderFileUploadRes, strconv.Itoa(common.Success))
 	c.Writer.Header().Set(common.HeaderFileHash, fi.Md5)
 	c.Writer.Header().Set(common.HeaderFilePath, filePath+"/"+fileName)
@@ -154,40 +166,30 @@ func (s *Storage) QuickUpload(c *gin.Context) {
 	})
 }
 
-//GenFileStaticUrl 生成文件url
+//GenFileStaticUrl 生成文件url，委托给存储驱动以便对象存储后端返回桶/CDN地址
 func (s *Storage) GenFileStaticUrl(basePath, filename string) (url string) {
-	c := config()
-	p := basePath + "/" + filename
-	//todo domain域名
-	url = fmt.Sprintf("%s://%s/%s/%s", s.httpSchema, net.JoinHostPort(c.Host, c.Port), c.Storage.Group, p)
+	key := basePath + "/" + filename
+	url, err := s.driver.PresignGet(context.Background(), key, 0)
+	if err != nil {
+		logger.Error("生成文件url失败", zap.String("key", key), zap.Error(err))
+	}
 	return
 }
 
-//SaveQuickUploadedFile 保存快传文件
-func (s *Storage) SaveQuickUploadedFile(file *multipart.FileHeader, dst string, hash string) (md5hash string, err error) {
+//SaveQuickUploadedFile 通过存储驱动保存快传文件，key为相对StorageDir/桶的路径
+func (s *Storage) SaveQuickUploadedFile(file *multipart.FileHeader, key string, hash string) (md5hash string, err error) {
 	src, err := file.Open()
 	if err != nil {
 		return
 	}
-	out, err := os.Create(dst)
-	if err != nil {
-		return
-	}
 	defer src.Close()
-	defer out.Close()
-	_, err = io.Copy(out, src)
-	if err != nil {
-		return
-	}
-	//检查文件完整性
-	local, err := os.Open(dst)
+	md5hash, err = s.driver.Put(context.Background(), key, src, file.Size)
 	if err != nil {
 		return
 	}
-	md5hash, _ = util.GenMD5(local)
 	logger.Info("md5", zap.String("md5", md5hash))
 	if hash != md5hash && hash != "" {
-		go os.Remove(dst)
+		go s.driver.Delete(context.Background(), key)
 		err = errors.New("file is already damaged")
 		return
 	}
@@ -196,6 +198,12 @@ func (s *Storage) SaveQuickUploadedFile(file *multipart.FileHeader, dst string,
 
 //Download 下载
 func (s *Storage) Download(c *gin.Context) {
+	//多文件打包下载走异步任务队列，客户端轮询/v1/task/:id拿到归档文件路径后再次请求
+	if c.Query("paths") != "" {
+		s.DownloadArchive(c)
+		return
+	}
+
 	filePath := c.Query("file")
 	if filePath == "" {
 		c.JSON(http.StatusOK, model.RespResult{
@@ -203,22 +211,9 @@ func (s *Storage) Download(c *gin.Context) {
 		})
 		return
 	}
-	fullPath := config().Storage.StorageDir + "/" + filePath
-	if _, err := os.Stat(fullPath); err != nil {
-		c.JSON(http.StatusOK, model.RespResult{
-			Status:  common.Fail,
-			Message: "no such file",
-		})
-		return
-	}
-	filename := c.GetHeader(common.HeaderDownloadFilename)
-	if filename == "" {
-		filename = path.Base(filePath)
-	}
-	//对下载的文件重命名
-	c.Writer.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
-	c.Writer.Header().Add("Content-Type", util.GetFileContentType(path.Ext(filePath)))
-	c.File(fullPath)
+	c.Writer.Header().Set("Content-Type", util.GetFileContentType(path.Ext(filePath)))
+	//支持Range/条件请求的断点下载，读取经由存储驱动完成
+	s.rangeDownload(c, filePath, filePath)
 }
 
 //Status 向tracker回报状态
@@ -230,10 +225,10 @@ func (s *Storage) Status() {
 		Host:       c.Host,
 		Port:       c.Port,
 	}
-	if stat, err := disk.Usage(c.Storage.StorageDir); err != nil {
-		status.Free = 0
+	if free, ok := s.driver.FreeSpace(context.Background()); ok {
+		status.Free = free
 	} else {
-		status.Free = stat.Free
+		status.Free = 0 //对象存储后端容量视为无限，上报0表示"unlimited"
 	}
 
 	for _, url := range s.trackers {
@@ -258,6 +253,16 @@ func (s *Storage) Sync(c *gin.Context) {
 	if sync.Action == common.SyncDelete {
 		syncFunc = s.SyncFileDelete
 	}
+	//mkdir/rename/move 用于维持跨节点的目录命名空间一致
+	if sync.Action == common.SyncMkdir {
+		syncFunc = s.SyncMkdir
+	}
+	if sync.Action == common.SyncRename {
+		syncFunc = s.SyncRename
+	}
+	if sync.Action == common.SyncMove {
+		syncFunc = s.SyncMove
+	}
 
 	if syncFunc != nil {
 		syncFunc(sync, c)
@@ -267,19 +272,10 @@ func (s *Storage) Sync(c *gin.Context) {
 //SyncFunc 同步函数
 type SyncFunc func(model.SyncFileInfo, *gin.Context)
 
-//SyncFileAdd 文件新增同步函数
+//SyncFileAdd 文件新增同步函数，下载并发数受syncSem(Storage.MaxParallelTransfer)限制，避免大量并发同步打满本节点带宽/连接数
 func (s *Storage) SyncFileAdd(sync model.SyncFileInfo, c *gin.Context) {
-	base := config().Storage.StorageDir + "/" + sync.FilePath
-	if _, err := os.Stat(base); err != nil {
-		err := os.MkdirAll(base, os.ModePerm)
-		if err != nil {
-			go s.TransErrorLogToTracker(common.DirCreateFail, "文件保存路径创建失败"+base)
-			c.JSON(http.StatusOK, model.RespResult{
-				Status: common.DirCreateFail,
-			})
-			return
-		}
-	}
+	s.syncSem <- struct{}{}
+	defer func() { <-s.syncSem }()
 
 	//download file
 	url := fmt.Sprintf("%s/%s/%s/%s", sync.Src, sync.Group, sync.FilePath, sync.FileName)
@@ -291,6 +287,7 @@ func (s *Storage) SyncFileAdd(sync model.SyncFileInfo, c *gin.Context) {
 		})
 		return
 	}
+	defer resp.Body.Close()
 	//if resp != nil {
 	//	//检查校验和
 	//	md5hash, _ := util.GenMD5(resp.Body)
@@ -299,34 +296,25 @@ func (s *Storage) SyncFileAdd(sync model.SyncFileInfo, c *gin.Context) {
 	//		return
 	//	}
 	//}
-	fullPath := base + "/" + sync.FileName
-	f, err := os.Create(fullPath)
+	key := sync.FilePath + "/" + sync.FileName
+	md5hash, err := s.driver.Put(context.Background(), key, resp.Body, resp.ContentLength)
 	if err != nil {
-		go s.TransErrorLogToTracker(common.DirCreateFail, "文件保存路径创建失败"+fullPath)
-		c.JSON(http.StatusOK, model.RespResult{
-			Status: common.DirCreateFail,
-		})
-		return
-	}
-	l, err := io.Copy(f, resp.Body)
-	defer f.Close()
-	if err != nil || l <= 0 {
-		go s.TransErrorLogToTracker(common.FileSaveFail, "文件同步保存失败"+fullPath)
+		go s.TransErrorLogToTracker(common.FileSaveFail, "文件同步保存失败"+key)
 		c.JSON(http.StatusOK, model.RespResult{
 			Status: common.Fail,
 		})
 		return
 	}
 
-	info, _ := os.Stat(fullPath)
+	info, _ := s.driver.Stat(context.Background(), key)
 	fi := model.FileInfo{
 		FileId: sync.FileId,
-		Name:   info.Name(),
-		ReName: info.Name(),
+		Name:   sync.FileName,
+		ReName: sync.FileName,
 		Url:    s.GenFileStaticUrl(sync.FilePath, sync.FileName),
-		Size:   info.Size(),
+		Size:   info.Size,
 		Path:   sync.FilePath,
-		Md5:    sync.FileHash,
+		Md5:    md5hash,
 		Group:  sync.Group,
 	}
 	bytes, _ := json.Marshal(fi)
@@ -338,16 +326,13 @@ func (s *Storage) SyncFileAdd(sync model.SyncFileInfo, c *gin.Context) {
 
 //SyncFileDelete 文件删除同步函数
 func (s *Storage) SyncFileDelete(sync model.SyncFileInfo, c *gin.Context) {
-	gf := config()
-	//拼接路径
-	fullPath := strings.Join([]string{gf.Storage.StorageDir, sync.FilePath, sync.FileName}, "/")
-	if _, err := os.Stat(fullPath); err != nil {
+	key := strings.Join([]string{sync.FilePath, sync.FileName}, "/")
+	if _, err := s.driver.Stat(context.Background(), key); err != nil {
 		c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
 		return
 	}
 	//删除文件
-	err := os.Remove(fullPath)
-	if err != nil {
+	if err := s.driver.Delete(context.Background(), key); err != nil {
 		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail})
 		return
 	}
@@ -389,6 +374,22 @@ func (s *Storage) startTimerTask() error {
 	if err != nil {
 		return err
 	}
+	//每小时清理一次过期的分片上传
+	_, err = cr.AddFunc("0 0 * * * *", func() {
+		s.cleanStaleUploads()
+	})
+	if err != nil {
+		return err
+	}
+	//每10分钟检查一次纠删码分片存活情况，修复丢失的分片
+	if config().Storage.ReplicationMode == "ec" {
+		_, err = cr.AddFunc("0 */10 * * * *", func() {
+			s.repairShards()
+		})
+		if err != nil {
+			return err
+		}
+	}
 	cr.Start()
 	return nil
 }
@@ -406,22 +407,54 @@ func (s *Storage) Start() {
 		logger.Info("文件保存路径创建成功", zap.String("storage_dir", p))
 	}
 
+	//初始化异步任务队列并恢复未完成的任务
+	s.initTaskQueue()
+
 	r := gin.Default()
 
 	//file system
-	r.StaticFS(conf.Config().Storage.Group, http.Dir(config().Storage.StorageDir))
+	r.Group("/"+conf.Config().Storage.Group, RequireSignedURL()).
+		StaticFS("/", http.Dir(config().Storage.StorageDir))
 
 	r.GET("/hello", hello)
 
 	//download file
-	r.GET("/download", s.Download)
+	r.GET("/download", RequireSignedURL(), s.Download)
+
+	//issue signed URLs consumed by RequireSignedURL
+	r.GET("/v1/sign", s.SignFile)
 
 	//sync file
 	r.POST("/sync", s.Sync)
-	r.Group("/v1")
+	v1 := r.Group("/v1")
 	{
 		//upload file
 		r.POST("/upload", s.QuickUpload)
+
+		//resumable chunked upload
+		v1.POST("/upload/init", s.UploadInit)
+		v1.POST("/upload/chunk", s.UploadChunk)
+		v1.GET("/upload/status", s.UploadStatus)
+		v1.POST("/upload/complete", s.UploadComplete)
+
+		//erasure-coded replication
+		v1.POST("/shard", s.ReceiveShard)
+		v1.GET("/shard", s.GetShard)
+		v1.HEAD("/shard", s.GetShard)
+		v1.GET("/reconstruct", s.Reconstruct)
+
+		//directory browse
+		v1.GET("/fs/list", s.List)
+		v1.GET("/fs/thumb", s.Thumb)
+		v1.POST("/fs/mkdir", s.Mkdir)
+		v1.POST("/fs/rename", s.Rename)
+		v1.POST("/fs/move", s.Move)
+		v1.DELETE("/fs/rm", s.Rm)
+
+		//async task queue
+		v1.POST("/task", s.CreateTask)
+		v1.GET("/task/:id", s.TaskStatus)
+		v1.DELETE("/task/:id", s.CancelTask)
 	}
 
 	//开启定时任务
@@ -0,0 +1,211 @@
+//Package task 实现一个由EggDB持久化的异步任务队列，支撑压缩/解压、转码、跨节点传输等耗时操作
+package task
+
+import (
+	"context"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+//Status 任务状态
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+const jobKeyPref = "task:"
+
+//Job 持久化到EggDB的任务记录
+type Job struct {
+	Id        string          `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    Status          `json:"status"`
+	Progress  int64           `json:"progress"`
+	Error     string          `json:"error,omitempty"`
+	CreatedAt int64           `json:"created_at"`
+	UpdatedAt int64           `json:"updated_at"`
+}
+
+//Checkpoint 供Handler周期性上报进度，每次调用都会把Job.Progress落盘；Progress只用于查询展示，重启后任务不会从该进度续跑
+type Checkpoint func(progress int64) error
+
+//Handler 具体任务类型的执行体，ctx在任务被取消时会被cancel
+type Handler func(ctx context.Context, job *Job, checkpoint Checkpoint) error
+
+//Queue 任务队列，worker数量由MaxWorkers控制
+type Queue struct {
+	db       *model.EggDB
+	handlers map[string]Handler
+	sem      chan struct{}
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+//NewQueue 创建任务队列，maxWorkers控制并发worker数
+func NewQueue(db *model.EggDB, maxWorkers int) *Queue {
+	if maxWorkers <= 0 {
+		maxWorkers = 1
+	}
+	return &Queue{
+		db:       db,
+		handlers: make(map[string]Handler),
+		sem:      make(chan struct{}, maxWorkers),
+		cancels:  make(map[string]context.CancelFunc),
+	}
+}
+
+//Register 注册某个任务类型的执行体，须在Enqueue/Resume前完成
+func (q *Queue) Register(jobType string, h Handler) {
+	q.handlers[jobType] = h
+}
+
+//Enqueue 新建一个任务并立即异步调度执行
+func (q *Queue) Enqueue(id, jobType string, payload interface{}) (*Job, error) {
+	if _, ok := q.handlers[jobType]; !ok {
+		return nil, fmt.Errorf("unknown job type: %s", jobType)
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	job := &Job{Id: id, Type: jobType, Payload: raw, Status: StatusPending, CreatedAt: now, UpdatedAt: now}
+	if err := q.save(job); err != nil {
+		return nil, err
+	}
+	go q.run(job)
+	return job, nil
+}
+
+//Get 读取任务当前状态/进度
+func (q *Queue) Get(id string) (*Job, error) {
+	return q.load(id)
+}
+
+//Cancel 取消一个正在运行或排队中的任务
+func (q *Queue) Cancel(id string) error {
+	q.mu.Lock()
+	cancel, ok := q.cancels[id]
+	q.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	job, err := q.load(id)
+	if err != nil {
+		return err
+	}
+	if job.Status == StatusPending || job.Status == StatusRunning {
+		job.Status = StatusCancelled
+		job.UpdatedAt = time.Now().Unix()
+		return q.save(job)
+	}
+	return nil
+}
+
+//Resume 在进程重启后扫描未完成(pending/running)的任务并重新调度；Handler从头重新执行，不会从上次的Progress继续
+func (q *Queue) Resume() {
+	keys, err := q.db.Keys(jobKeyPref)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		job, err := q.loadByKey(key)
+		if err != nil {
+			continue
+		}
+		if job.Status == StatusPending || job.Status == StatusRunning {
+			logger.Info("恢复未完成任务", zap.String("job_id", job.Id), zap.String("type", job.Type))
+			go q.run(job)
+		}
+	}
+}
+
+func (q *Queue) run(job *Job) {
+	q.sem <- struct{}{}
+	defer func() { <-q.sem }()
+
+	handler, ok := q.handlers[job.Type]
+	if !ok {
+		job.Status = StatusFailed
+		job.Error = "unknown job type"
+		_ = q.save(job)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.mu.Lock()
+	q.cancels[job.Id] = cancel
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.cancels, job.Id)
+		q.mu.Unlock()
+		cancel()
+	}()
+
+	//排队期间已被Cancel的任务不再执行
+	if cur, err := q.load(job.Id); err == nil && cur.Status == StatusCancelled {
+		return
+	}
+
+	job.Status = StatusRunning
+	job.UpdatedAt = time.Now().Unix()
+	_ = q.save(job)
+
+	checkpoint := func(progress int64) error {
+		job.Progress = progress
+		job.UpdatedAt = time.Now().Unix()
+		return q.save(job)
+	}
+
+	err := handler(ctx, job, checkpoint)
+	job.UpdatedAt = time.Now().Unix()
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		job.Status = StatusCancelled
+	case err != nil:
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	default:
+		job.Status = StatusCompleted
+		job.Progress = 100
+	}
+	_ = q.save(job)
+}
+
+func (q *Queue) save(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.db.Put(jobKeyPref+job.Id, data)
+}
+
+func (q *Queue) load(id string) (*Job, error) {
+	return q.loadByKey(jobKeyPref + id)
+}
+
+func (q *Queue) loadByKey(key string) (*Job, error) {
+	data, err := q.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
@@ -0,0 +1,37 @@
+package task
+
+//任务类型
+const (
+	TypeArchiveCreate  = "archive_create"
+	TypeArchiveExtract = "archive_extract"
+	TypeTranscode      = "transcode"
+	TypeReplicate      = "replicate"
+)
+
+//ArchiveCreatePayload ArchiveCreate任务参数：把Paths打包为Format(zip/tar.gz)格式的归档文件
+type ArchiveCreatePayload struct {
+	Paths    []string `json:"paths"`
+	Format   string   `json:"format"`
+	DestPath string   `json:"dest_path"`
+}
+
+//ArchiveExtractPayload ArchiveExtract任务参数：解压ArchivePath到TargetDir，DecompressLimit为解压后总字节数上限(<=0不限制)，
+//取自提交任务时的decompress_limit参数，不读取组配置中的限额
+type ArchiveExtractPayload struct {
+	ArchivePath     string `json:"archive_path"`
+	TargetDir       string `json:"target_dir"`
+	DecompressLimit int64  `json:"decompress_limit"`
+}
+
+//TranscodePayload Transcode任务参数：用ffmpeg把SrcPath转码为DestPath，Args为额外ffmpeg参数
+type TranscodePayload struct {
+	SrcPath  string   `json:"src_path"`
+	DestPath string   `json:"dest_path"`
+	Args     []string `json:"args"`
+}
+
+//ReplicatePayload Replicate任务参数：把Path批量复制到Peers
+type ReplicatePayload struct {
+	Path  string   `json:"path"`
+	Peers []string `json:"peers"`
+}
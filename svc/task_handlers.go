@@ -0,0 +1,350 @@
+package svc
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/svc/task"
+	"eggdfs/util"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//initTaskQueue 创建任务队列并注册所有任务类型的执行体，supervisor在Start中调用
+func (s *Storage) initTaskQueue() {
+	s.tasks = task.NewQueue(s.db, config().Task.MaxWorkers)
+	s.tasks.Register(task.TypeArchiveCreate, s.runArchiveCreate)
+	s.tasks.Register(task.TypeArchiveExtract, s.runArchiveExtract)
+	s.tasks.Register(task.TypeTranscode, s.runTranscode)
+	s.tasks.Register(task.TypeReplicate, s.runReplicate)
+	s.tasks.Resume()
+}
+
+//CreateTask POST /v1/task 提交一个异步任务
+func (s *Storage) CreateTask(c *gin.Context) {
+	jobType := c.PostForm("type")
+	uuid := c.GetHeader(common.HeaderFileUUID)
+	id := util.GenFileName(uuid, jobType)
+
+	var payload interface{}
+	switch jobType {
+	case task.TypeArchiveCreate:
+		payload = task.ArchiveCreatePayload{
+			Paths:    strings.Split(c.PostForm("paths"), ","),
+			Format:   c.DefaultPostForm("format", "zip"),
+			DestPath: c.PostForm("dest_path"),
+		}
+	case task.TypeArchiveExtract:
+		limit, _ := strconv.ParseInt(c.PostForm("decompress_limit"), 10, 64)
+		payload = task.ArchiveExtractPayload{
+			ArchivePath:     c.PostForm("archive_path"),
+			TargetDir:       c.PostForm("target_dir"),
+			DecompressLimit: limit,
+		}
+	case task.TypeTranscode:
+		payload = task.TranscodePayload{
+			SrcPath:  c.PostForm("src_path"),
+			DestPath: c.PostForm("dest_path"),
+			Args:     strings.Fields(c.PostForm("args")),
+		}
+	case task.TypeReplicate:
+		payload = task.ReplicatePayload{
+			Path:  c.PostForm("path"),
+			Peers: strings.Split(c.PostForm("peers"), ","),
+		}
+	default:
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail, Message: "unknown task type"})
+		return
+	}
+
+	job, err := s.tasks.Enqueue(id, jobType, payload)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success, Data: job})
+}
+
+//TaskStatus GET /v1/task/:id 查询任务进度
+func (s *Storage) TaskStatus(c *gin.Context) {
+	job, err := s.tasks.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "task not found"})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success, Data: job})
+}
+
+//CancelTask DELETE /v1/task/:id 取消任务
+func (s *Storage) CancelTask(c *gin.Context) {
+	if err := s.tasks.Cancel(c.Param("id")); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+}
+
+//DownloadArchive GET /download?paths=a,b,c&archive=zip 将打包请求转成一个ArchiveCreate任务，客户端轮询/v1/task/:id后再次GET取回结果
+func (s *Storage) DownloadArchive(c *gin.Context) {
+	paths := strings.Split(c.Query("paths"), ",")
+	format := c.DefaultQuery("archive", "zip")
+	uuid := c.GetHeader(common.HeaderFileUUID)
+	id := util.GenFileName(uuid, "archive")
+	destPath := fmt.Sprintf(".archives/%s.%s", id, format)
+
+	job, err := s.tasks.Enqueue(id, task.TypeArchiveCreate, task.ArchiveCreatePayload{
+		Paths: paths, Format: format, DestPath: destPath,
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success, Data: job})
+}
+
+func (s *Storage) runArchiveCreate(ctx context.Context, job *task.Job, checkpoint task.Checkpoint) error {
+	if err := requireLocalDriver(); err != nil {
+		return err
+	}
+	var payload task.ArchiveCreatePayload
+	if err := unmarshalPayload(job.Payload, &payload); err != nil {
+		return err
+	}
+	dest, err := safeJoin(config().Storage.StorageDir, payload.DestPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	switch payload.Format {
+	case "zip":
+		return archiveZip(ctx, out, payload.Paths, checkpoint)
+	case "tar.gz":
+		return archiveTarGz(ctx, out, payload.Paths, checkpoint)
+	default:
+		return fmt.Errorf("unsupported archive format: %s", payload.Format)
+	}
+}
+
+func archiveZip(ctx context.Context, out *os.File, paths []string, checkpoint task.Checkpoint) error {
+	zw := zip.NewWriter(out)
+	defer zw.Close()
+	var done int64
+	for _, p := range paths {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		full, err := safeJoin(config().Storage.StorageDir, p)
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create(filepath.Base(p))
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(full)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, f); err != nil {
+			f.Close()
+			return err
+		}
+		f.Close()
+		done++
+		_ = checkpoint(done * 100 / int64(len(paths)))
+	}
+	return nil
+}
+
+func archiveTarGz(ctx context.Context, out *os.File, paths []string, checkpoint task.Checkpoint) error {
+	gw := gzip.NewWriter(out)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+	var done int64
+	for _, p := range paths {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		full, err := safeJoin(config().Storage.StorageDir, p)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(full)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.Base(p)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(full)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, f); err != nil {
+			f.Close()
+			return err
+		}
+		f.Close()
+		done++
+		_ = checkpoint(done * 100 / int64(len(paths)))
+	}
+	return nil
+}
+
+func (s *Storage) runArchiveExtract(ctx context.Context, job *task.Job, checkpoint task.Checkpoint) error {
+	if err := requireLocalDriver(); err != nil {
+		return err
+	}
+	var payload task.ArchiveExtractPayload
+	if err := unmarshalPayload(job.Payload, &payload); err != nil {
+		return err
+	}
+	archivePath, err := safeJoin(config().Storage.StorageDir, payload.ArchivePath)
+	if err != nil {
+		return err
+	}
+	targetDir, err := safeJoin(config().Storage.StorageDir, payload.TargetDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(targetDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var extracted int64
+	for i, f := range r.File {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		extracted += int64(f.UncompressedSize64)
+		if payload.DecompressLimit > 0 && extracted > payload.DecompressLimit {
+			return fmt.Errorf("解压后体积超过限额 %d 字节", payload.DecompressLimit)
+		}
+		if err := extractZipEntry(f, targetDir); err != nil {
+			return err
+		}
+		_ = checkpoint(int64(i+1) * 100 / int64(len(r.File)))
+	}
+	return nil
+}
+
+func extractZipEntry(f *zip.File, targetDir string) error {
+	dst, err := safeJoin(targetDir, f.Name)
+	if err != nil {
+		return fmt.Errorf("非法的压缩包条目路径: %s", f.Name)
+	}
+	if f.FileInfo().IsDir() {
+		return os.MkdirAll(dst, os.ModePerm)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, rc)
+	return err
+}
+
+//runTranscode 在装有ffmpeg的节点上对媒体文件转码
+func (s *Storage) runTranscode(ctx context.Context, job *task.Job, checkpoint task.Checkpoint) error {
+	if err := requireLocalDriver(); err != nil {
+		return err
+	}
+	var payload task.TranscodePayload
+	if err := unmarshalPayload(job.Payload, &payload); err != nil {
+		return err
+	}
+	src, err := safeJoin(config().Storage.StorageDir, payload.SrcPath)
+	if err != nil {
+		return err
+	}
+	dst, err := safeJoin(config().Storage.StorageDir, payload.DestPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	args := append([]string{"-y", "-i", src}, payload.Args...)
+	args = append(args, dst)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg转码失败: %w", err)
+	}
+	_ = checkpoint(100)
+	return nil
+}
+
+//runReplicate 将本地文件批量复制到N个对等节点，复用sync机制
+func (s *Storage) runReplicate(ctx context.Context, job *task.Job, checkpoint task.Checkpoint) error {
+	var payload task.ReplicatePayload
+	if err := unmarshalPayload(job.Payload, &payload); err != nil {
+		return err
+	}
+	var done int64
+	for _, peer := range payload.Peers {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		sync := model.SyncFileInfo{
+			Action:   common.SyncAdd,
+			Src:      fmt.Sprintf("%s://%s", s.httpSchema, net.JoinHostPort(config().Host, config().Port)),
+			Group:    config().Storage.Group,
+			FilePath: filepath.Dir(payload.Path),
+			FileName: filepath.Base(payload.Path),
+		}
+		if _, err := util.HttpPost(peer+"/sync", sync, nil, time.Second*30); err != nil {
+			logger.Warn("跨节点复制失败", zap.String("peer", peer), zap.String("path", payload.Path))
+		}
+		done++
+		_ = checkpoint(done * 100 / int64(len(payload.Peers)))
+	}
+	return nil
+}
+
+func unmarshalPayload(raw []byte, v interface{}) error {
+	return json.Unmarshal(raw, v)
+}
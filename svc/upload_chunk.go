@@ -0,0 +1,316 @@
+package svc
+
+import (
+	"context"
+	"eggdfs/common"
+	"eggdfs/common/model"
+	"eggdfs/logger"
+	"eggdfs/util"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	uploadTmpDirName      = ".uploads"
+	defaultChunkSize      = 4 * 1024 * 1024 // 4MB
+	uploadMetaKeyPref     = "upload:meta:"
+	defaultUploadIdleTTL  = time.Hour * 24
+)
+
+//uploadIdleTTL 分片上传的空闲过期时间，可通过Storage.UploadIdleTTLSeconds配置，未配置时使用默认值
+func uploadIdleTTL() time.Duration {
+	if sec := config().Storage.UploadIdleTTLSeconds; sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	return defaultUploadIdleTTL
+}
+
+//ChunkUploadInfo 分片上传会话信息，保存在EggDB中
+type ChunkUploadInfo struct {
+	UploadId   string `json:"upload_id"`
+	FileName   string `json:"file_name"`
+	FileHash   string `json:"file_hash"` //完整文件md5，complete时校验
+	Size       int64  `json:"size"`
+	ChunkSize  int64  `json:"chunk_size"`
+	ChunkCount int    `json:"chunk_count"`
+	Received   []bool `json:"received"` //每个分片是否已接收，充当位图
+	CreatedAt  int64  `json:"created_at"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
+
+func (s *Storage) uploadTmpDir(uploadId string) string {
+	return fmt.Sprintf("%s/%s/%s", config().Storage.StorageDir, uploadTmpDirName, uploadId)
+}
+
+func (s *Storage) saveUploadMeta(info *ChunkUploadInfo) error {
+	bytes, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(uploadMetaKeyPref+info.UploadId, bytes)
+}
+
+func (s *Storage) loadUploadMeta(uploadId string) (*ChunkUploadInfo, error) {
+	data, err := s.db.Get(uploadMetaKeyPref + uploadId)
+	if err != nil {
+		return nil, err
+	}
+	info := &ChunkUploadInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+//UploadInit 初始化一次分片上传，返回upload_id、分片大小和分片数量
+func (s *Storage) UploadInit(c *gin.Context) {
+	fileName := c.Query("file_name")
+	sizeStr := c.Query("size")
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if fileName == "" || err != nil || size <= 0 {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
+		return
+	}
+	if config().Storage.FileSizeLimit > 0 && size > config().Storage.FileSizeLimit {
+		c.JSON(http.StatusOK, model.RespResult{
+			Status:  common.FileSizeExceeded,
+			Message: "文件大小超过限制",
+		})
+		return
+	}
+
+	chunkSize := int64(defaultChunkSize)
+	chunkCount := int((size + chunkSize - 1) / chunkSize)
+	uploadId := util.GenFileName(c.GetHeader(common.HeaderFileUUID), fileName)
+
+	if err := os.MkdirAll(s.uploadTmpDir(uploadId), os.ModePerm); err != nil {
+		logger.Error("分片上传临时目录创建失败", zap.String("upload_id", uploadId))
+		c.JSON(http.StatusOK, model.RespResult{Status: common.DirCreateFail})
+		return
+	}
+
+	now := time.Now().Unix()
+	info := &ChunkUploadInfo{
+		UploadId:   uploadId,
+		FileName:   fileName,
+		FileHash:   c.GetHeader(common.HeaderFileHash),
+		Size:       size,
+		ChunkSize:  chunkSize,
+		ChunkCount: chunkCount,
+		Received:   make([]bool, chunkCount),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := s.saveUploadMeta(info); err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   info,
+	})
+}
+
+//UploadChunk 接收单个分片，校验分片md5后落盘
+func (s *Storage) UploadChunk(c *gin.Context) {
+	uploadId := c.PostForm("upload_id")
+	indexStr := c.PostForm("chunk_index")
+	chunkMd5 := c.PostForm("chunk_md5")
+	index, err := strconv.Atoi(indexStr)
+	if uploadId == "" || err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
+		return
+	}
+
+	info, err := s.loadUploadMeta(uploadId)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "upload_id不存在或已过期"})
+		return
+	}
+	if index < 0 || index >= info.ChunkCount {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.ParamBindFail})
+		return
+	}
+
+	file, err := c.FormFile("chunk")
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.FormFileNotFound})
+		return
+	}
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail})
+		return
+	}
+	defer src.Close()
+
+	chunkPath := fmt.Sprintf("%s/%d", s.uploadTmpDir(uploadId), index)
+	out, err := os.Create(chunkPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.FileSaveFail})
+		return
+	}
+	if _, err = io.Copy(out, src); err != nil {
+		out.Close()
+		c.JSON(http.StatusOK, model.RespResult{Status: common.FileSaveFail})
+		return
+	}
+	out.Close()
+
+	if chunkMd5 != "" {
+		local, err := os.Open(chunkPath)
+		if err == nil {
+			md5hash, _ := util.GenMD5(local)
+			local.Close()
+			if md5hash != chunkMd5 {
+				_ = os.Remove(chunkPath)
+				c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "分片校验失败"})
+				return
+			}
+		}
+	}
+
+	info.Received[index] = true
+	info.UpdatedAt = time.Now().Unix()
+	_ = s.saveUploadMeta(info)
+	c.JSON(http.StatusOK, model.RespResult{Status: common.Success})
+}
+
+//UploadStatus 返回已接收分片的位图，供客户端断点续传
+func (s *Storage) UploadStatus(c *gin.Context) {
+	uploadId := c.Query("upload_id")
+	info, err := s.loadUploadMeta(uploadId)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "upload_id不存在或已过期"})
+		return
+	}
+	c.JSON(http.StatusOK, model.RespResult{
+		Status: common.Success,
+		Data:   info,
+	})
+}
+
+//UploadComplete 按序拼接所有分片，校验整体md5后经存储驱动写入并记录FileInfo；不向tracker发起同步
+func (s *Storage) UploadComplete(c *gin.Context) {
+	uploadId := c.PostForm("upload_id")
+	info, err := s.loadUploadMeta(uploadId)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "upload_id不存在或已过期"})
+		return
+	}
+	for i, ok := range info.Received {
+		if !ok {
+			c.JSON(http.StatusOK, model.RespResult{
+				Status:  common.Fail,
+				Message: fmt.Sprintf("分片%d尚未上传", i),
+			})
+			return
+		}
+	}
+
+	customDir := c.GetHeader(common.HeaderUploadFileDir)
+	filePath := util.GenFilePath(customDir)
+	fileName := util.GenFileName(c.GetHeader(common.HeaderFileUUID), info.FileName)
+	key := filePath + "/" + fileName
+
+	//先在本地暂存目录按序拼接分片，校验完整性后再交给存储驱动写入最终后端，
+	//做法与SaveQuickUploadedFile/SyncFileAdd保持一致，不再绕过driver直接写StorageDir
+	mergedPath := fmt.Sprintf("%s/merged", s.uploadTmpDir(uploadId))
+	out, err := os.Create(mergedPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.FileSaveFail})
+		return
+	}
+	for i := 0; i < info.ChunkCount; i++ {
+		chunkPath := fmt.Sprintf("%s/%d", s.uploadTmpDir(uploadId), i)
+		in, err := os.Open(chunkPath)
+		if err != nil {
+			out.Close()
+			c.JSON(http.StatusOK, model.RespResult{Status: common.FileSaveFail, Message: err.Error()})
+			return
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			out.Close()
+			c.JSON(http.StatusOK, model.RespResult{Status: common.FileSaveFail, Message: err.Error()})
+			return
+		}
+	}
+	out.Close()
+
+	local, err := os.Open(mergedPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail})
+		return
+	}
+	md5hash, _ := util.GenMD5(local)
+	local.Close()
+	if info.FileHash != "" && md5hash != info.FileHash {
+		_ = os.Remove(mergedPath)
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail, Message: "文件完整性校验失败"})
+		return
+	}
+
+	merged, err := os.Open(mergedPath)
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.Fail})
+		return
+	}
+	_, err = s.driver.Put(context.Background(), key, merged, info.Size)
+	merged.Close()
+	if err != nil {
+		c.JSON(http.StatusOK, model.RespResult{Status: common.FileSaveFail, Message: err.Error()})
+		return
+	}
+
+	fi := model.FileInfo{
+		Name:   info.FileName,
+		ReName: fileName,
+		Url:    s.GenFileStaticUrl(filePath, fileName),
+		Path:   key,
+		Md5:    md5hash,
+		Size:   info.Size,
+		Group:  config().Storage.Group,
+	}
+	bytes, _ := json.Marshal(fi)
+	_ = s.db.Put(fi.Md5, bytes)
+	_ = s.db.Delete(uploadMetaKeyPref + uploadId)
+	_ = os.RemoveAll(s.uploadTmpDir(uploadId))
+
+	c.JSON(http.StatusOK, model.RespResult{
+		Status:  common.Success,
+		Message: "文件保存成功",
+		Data:    fi,
+	})
+}
+
+//cleanStaleUploads 清理长时间未完成的分片上传
+func (s *Storage) cleanStaleUploads() {
+	keys, err := s.db.Keys(uploadMetaKeyPref)
+	if err != nil {
+		return
+	}
+	now := time.Now().Unix()
+	for _, key := range keys {
+		uploadId := strings.TrimPrefix(key, uploadMetaKeyPref)
+		info, err := s.loadUploadMeta(uploadId)
+		if err != nil {
+			continue
+		}
+		if now-info.UpdatedAt < int64(uploadIdleTTL().Seconds()) {
+			continue
+		}
+		logger.Info("清理过期分片上传", zap.String("upload_id", uploadId))
+		_ = os.RemoveAll(s.uploadTmpDir(uploadId))
+		_ = s.db.Delete(uploadMetaKeyPref + uploadId)
+	}
+}